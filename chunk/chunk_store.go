@@ -88,7 +88,9 @@ func init() {
 	prometheus.MustRegister(s3RequestDuration)
 }
 
-// Store type stores and indexes chunks
+// Store type stores and indexes chunks. Once Put returned, Get returns the
+// chunks, but only some stores guarantee that they are durable by then; see
+// CoalescingStore.
 type Store interface {
 	Put(ctx context.Context, chunks []Chunk) error
 	Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error)
@@ -55,8 +55,8 @@ func TestIntersect(t *testing.T) {
 	}
 }
 
-func TestChunkStore(t *testing.T) {
-	store := AWSStore{
+func newTestAWSStore() *AWSStore {
+	store := &AWSStore{
 		dynamodb:   mockaws.NewMockDynamoDB(),
 		s3:         mockaws.NewMockS3(),
 		chunkCache: nil,
@@ -65,6 +65,11 @@ func TestChunkStore(t *testing.T) {
 		putLimiter: NoopSemaphore,
 	}
 	store.CreateTables()
+	return store
+}
+
+func TestChunkStore(t *testing.T) {
+	store := newTestAWSStore()
 
 	ctx := user.WithID(context.Background(), "0")
 	now := model.Now()
@@ -0,0 +1,346 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunk
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/frankenstein/user"
+)
+
+// blobIDPrefix marks the chunks written by a CoalescingStore.
+const blobIDPrefix = "blob:"
+
+// CoalescingStoreConfig specifies config for a CoalescingStore.
+type CoalescingStoreConfig struct {
+	// The buffered chunks of a series are written once there are MaxChunks
+	// of them, or once the oldest has been buffered for MaxWait. Buffers
+	// are checked for their age every MaxWait/2.
+	MaxChunks int
+	MaxWait   time.Duration
+}
+
+// CoalescingStore is a Store which writes the chunks of a series to the
+// underlying store as a single blob of several chunks, saving per-object
+// overhead. Get extracts the individual chunks again, and also returns
+// buffered ones, including those being written.
+//
+// Unlike other stores, a nil error from Put does not mean the chunks are
+// durable: Put returns once the chunks are buffered, and buffered chunks are
+// lost if the process dies before writing them, up to MaxWait after Put.
+// Blobs which fail to be written stay buffered and are retried, so Put never
+// returns their errors. Close writes all buffered chunks.
+type CoalescingStore struct {
+	store Store
+	cfg   CoalescingStoreConfig
+	quit  chan struct{}
+	done  chan struct{}
+
+	mtx     sync.Mutex
+	pending map[string]*pendingBlob
+	// Blobs taken from pending while they are written, so Get still
+	// returns their chunks.
+	writing map[*pendingBlob]struct{}
+}
+
+// pendingBlob holds the buffered chunks of a series.
+type pendingBlob struct {
+	userID string
+	chunks []Chunk
+	since  time.Time
+}
+
+// NewCoalescingStore makes a new CoalescingStore writing to store.
+func NewCoalescingStore(store Store, cfg CoalescingStoreConfig) *CoalescingStore {
+	if cfg.MaxChunks <= 0 {
+		cfg.MaxChunks = 10
+	}
+	if cfg.MaxWait <= 0 {
+		cfg.MaxWait = time.Minute
+	}
+	c := &CoalescingStore{
+		store:   store,
+		cfg:     cfg,
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		pending: map[string]*pendingBlob{},
+		writing: map[*pendingBlob]struct{}{},
+	}
+	go c.loop()
+	return c
+}
+
+func (c *CoalescingStore) loop() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.cfg.MaxWait / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.writePending(time.Now().Add(-c.cfg.MaxWait)); err != nil {
+				log.Errorf("Error writing coalesced chunks: %v", err)
+			}
+		case <-c.quit:
+			return
+		}
+	}
+}
+
+// Close stops the CoalescingStore and writes all buffered chunks.
+func (c *CoalescingStore) Close() error {
+	close(c.quit)
+	<-c.done
+	return c.writePending(time.Now())
+}
+
+// Put implements Store. It buffers the chunks, and writes the blobs of series
+// which have MaxChunks buffered chunks. Failures to write them are logged, and
+// the blobs stay buffered to be retried.
+func (c *CoalescingStore) Put(ctx context.Context, chunks []Chunk) error {
+	userID, err := user.GetID(ctx)
+	if err != nil {
+		return err
+	}
+
+	var full []*pendingBlob
+	c.mtx.Lock()
+	for _, chunk := range chunks {
+		key := fmt.Sprintf("%s/%s", userID, chunk.Metric.Fingerprint())
+		p, ok := c.pending[key]
+		if !ok {
+			p = &pendingBlob{userID: userID, since: time.Now()}
+			c.pending[key] = p
+		}
+		p.chunks = append(p.chunks, chunk)
+		if len(p.chunks) >= c.cfg.MaxChunks {
+			full = append(full, p)
+			delete(c.pending, key)
+			c.writing[p] = struct{}{}
+		}
+	}
+	c.mtx.Unlock()
+
+	if err := c.write(full); err != nil {
+		log.Warnf("Error writing coalesced chunks, will retry: %v", err)
+	}
+	return nil
+}
+
+// writePending writes the buffered chunks of series buffered before cutoff.
+func (c *CoalescingStore) writePending(cutoff time.Time) error {
+	var due []*pendingBlob
+	c.mtx.Lock()
+	for key, p := range c.pending {
+		if p.since.Before(cutoff) {
+			due = append(due, p)
+			delete(c.pending, key)
+			c.writing[p] = struct{}{}
+		}
+	}
+	c.mtx.Unlock()
+
+	return c.write(due)
+}
+
+// write writes each blob, which the caller moved from pending to writing, to
+// the underlying store. Blobs which fail to be written are buffered again, to
+// be retried, and the last error is returned.
+func (c *CoalescingStore) write(blobs []*pendingBlob) error {
+	var lastErr error
+	for _, p := range blobs {
+		ctx := user.WithID(context.Background(), p.userID)
+		err := c.store.Put(ctx, []Chunk{encodeBlob(p.chunks)})
+		c.mtx.Lock()
+		delete(c.writing, p)
+		if err != nil {
+			lastErr = err
+			c.requeue(p)
+		}
+		c.mtx.Unlock()
+	}
+	return lastErr
+}
+
+// requeue buffers the chunks of a blob again. The caller must hold mtx.
+func (c *CoalescingStore) requeue(p *pendingBlob) {
+	key := fmt.Sprintf("%s/%s", p.userID, p.chunks[0].Metric.Fingerprint())
+	if q, ok := c.pending[key]; ok {
+		p.chunks = append(p.chunks, q.chunks...)
+	}
+	c.pending[key] = p
+}
+
+// Get implements Store.
+func (c *CoalescingStore) Get(ctx context.Context, from, through model.Time, matchers ...*metric.LabelMatcher) ([]Chunk, error) {
+	userID, err := user.GetID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := c.store.Get(ctx, from, through, matchers...)
+	if err != nil {
+		return nil, err
+	}
+
+	var chunks []Chunk
+	for _, chunk := range stored {
+		if !strings.HasPrefix(chunk.ID, blobIDPrefix) {
+			chunks = append(chunks, chunk)
+			continue
+		}
+		extracted, err := decodeBlob(chunk)
+		if err != nil {
+			log.Warnf("Error decoding coalesced chunks %s, returning the %d complete ones: %v", chunk.ID, len(extracted), err)
+		}
+		for _, e := range extracted {
+			if !e.From.After(through) && !e.Through.Before(from) {
+				chunks = append(chunks, e)
+			}
+		}
+	}
+
+	buffered := func(p *pendingBlob) {
+		if p.userID != userID {
+			return
+		}
+		for _, chunk := range p.chunks {
+			if !chunk.From.After(through) && !chunk.Through.Before(from) && matchesAll(chunk.Metric, matchers) {
+				chunks = append(chunks, chunk)
+			}
+		}
+	}
+	c.mtx.Lock()
+	for _, p := range c.pending {
+		buffered(p)
+	}
+	for p := range c.writing {
+		buffered(p)
+	}
+	c.mtx.Unlock()
+
+	// A blob written after reading the store is returned as buffered, one
+	// written since as stored too.
+	sort.Sort(ByID(chunks))
+	return uniqueByID(chunks), nil
+}
+
+// uniqueByID drops chunks with the ID of the one before from chunks sorted by
+// ID.
+func uniqueByID(chunks []Chunk) []Chunk {
+	if len(chunks) == 0 {
+		return chunks
+	}
+	unique := chunks[:1]
+	for _, chunk := range chunks[1:] {
+		if chunk.ID != unique[len(unique)-1].ID {
+			unique = append(unique, chunk)
+		}
+	}
+	return unique
+}
+
+func matchesAll(m model.Metric, matchers []*metric.LabelMatcher) bool {
+	for _, matcher := range matchers {
+		if !matcher.Match(m[matcher.Name]) {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeBlob combines chunks of the same series into a single chunk. Its data
+// is a sequence of records, each the chunk's ID, from and through time, and
+// data, so that a truncated blob still yields the chunks before the damage.
+func encodeBlob(chunks []Chunk) Chunk {
+	blob := Chunk{
+		ID:      blobIDPrefix + chunks[0].ID,
+		From:    chunks[0].From,
+		Through: chunks[0].Through,
+		Metric:  chunks[0].Metric,
+	}
+	size := 0
+	for _, chunk := range chunks {
+		size += 4*binary.MaxVarintLen64 + len(chunk.ID) + len(chunk.Data)
+	}
+	buf := make([]byte, 0, size)
+	var tmp [binary.MaxVarintLen64]byte
+	for _, chunk := range chunks {
+		if chunk.From.Before(blob.From) {
+			blob.From = chunk.From
+		}
+		if chunk.Through.After(blob.Through) {
+			blob.Through = chunk.Through
+		}
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(chunk.ID)))]...)
+		buf = append(buf, chunk.ID...)
+		buf = append(buf, tmp[:binary.PutVarint(tmp[:], int64(chunk.From))]...)
+		buf = append(buf, tmp[:binary.PutVarint(tmp[:], int64(chunk.Through))]...)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp[:], uint64(len(chunk.Data)))]...)
+		buf = append(buf, chunk.Data...)
+	}
+	blob.Data = buf
+	return blob
+}
+
+// decodeBlob extracts the chunks combined by encodeBlob. If the blob is
+// damaged, it returns the chunks before the damage, and an error.
+func decodeBlob(blob Chunk) ([]Chunk, error) {
+	var chunks []Chunk
+	buf := blob.Data
+	for len(buf) > 0 {
+		chunk := Chunk{Metric: blob.Metric}
+		id, rest, ok := readBytes(buf)
+		if !ok {
+			return chunks, fmt.Errorf("truncated chunk ID at chunk %d", len(chunks))
+		}
+		from, n := binary.Varint(rest)
+		if n <= 0 {
+			return chunks, fmt.Errorf("truncated from time at chunk %d", len(chunks))
+		}
+		rest = rest[n:]
+		through, n := binary.Varint(rest)
+		if n <= 0 {
+			return chunks, fmt.Errorf("truncated through time at chunk %d", len(chunks))
+		}
+		data, rest, ok := readBytes(rest[n:])
+		if !ok {
+			return chunks, fmt.Errorf("truncated data at chunk %d", len(chunks))
+		}
+		chunk.ID, chunk.From, chunk.Through, chunk.Data = string(id), model.Time(from), model.Time(through), data
+		chunks = append(chunks, chunk)
+		buf = rest
+	}
+	return chunks, nil
+}
+
+// readBytes reads a length-prefixed byte slice from buf, returning the rest.
+func readBytes(buf []byte) ([]byte, []byte, bool) {
+	l, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < l {
+		return nil, nil, false
+	}
+	buf = buf[n:]
+	return buf[:l], buf[l:], true
+}
@@ -0,0 +1,244 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package chunk
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/frankenstein/user"
+)
+
+func TestCoalescingStore(t *testing.T) {
+	store := newTestAWSStore()
+	coalescing := NewCoalescingStore(store, CoalescingStoreConfig{MaxChunks: 3, MaxWait: time.Hour})
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	baz := model.Metric{model.MetricNameLabel: "foo", "bar": "baz"}
+	beep := model.Metric{model.MetricNameLabel: "foo", "bar": "beep"}
+	var chunks []Chunk
+	for k, m := range []model.Metric{baz, beep, baz, baz} {
+		chunks = append(chunks, Chunk{
+			ID:      fmt.Sprintf("chunk%d", k),
+			From:    now.Add(time.Duration(k-4) * 10 * time.Minute),
+			Through: now.Add(time.Duration(k-3)*10*time.Minute - time.Millisecond),
+			Metric:  m,
+			Data:    []byte(fmt.Sprintf("data%d", k)),
+		})
+	}
+	nameMatcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+
+	test := func(name string, store Store, expect []Chunk, from model.Time, matchers ...*metric.LabelMatcher) {
+		have, err := store.Get(ctx, from, now, matchers...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(expect, have) {
+			t.Fatalf("%s: wrong chunks - %s", name, diff(expect, have))
+		}
+	}
+
+	if err := coalescing.Put(ctx, chunks[:3]); err != nil {
+		t.Fatal(err)
+	}
+	test("Buffered", coalescing, chunks[:3], now.Add(-time.Hour), nameMatcher)
+	if stored, err := store.Get(ctx, now.Add(-time.Hour), now, nameMatcher); err != nil || len(stored) != 0 {
+		t.Fatalf("expected nothing to be written yet, got %v, %v", stored, err)
+	}
+
+	// The third chunk of baz writes them as one blob.
+	if err := coalescing.Put(ctx, chunks[3:]); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := store.Get(ctx, now.Add(-time.Hour), now, nameMatcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || !strings.HasPrefix(stored[0].ID, blobIDPrefix) {
+		t.Fatalf("expected a single blob in the store, got %v", stored)
+	}
+	test("Extracted and buffered", coalescing, chunks, now.Add(-time.Hour), nameMatcher)
+	test("Matchers", coalescing, []Chunk{chunks[0], chunks[2], chunks[3]}, now.Add(-time.Hour), nameMatcher, mustNewLabelMatcher(metric.Equal, "bar", "baz"))
+	test("Time range", coalescing, chunks[2:], chunks[2].From, nameMatcher)
+
+	// Close writes the buffered chunk of beep.
+	if err := coalescing.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stored, err = store.Get(ctx, now.Add(-time.Hour), now, nameMatcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("expected 2 blobs in the store, got %v", stored)
+	}
+	test("Closed", coalescing, chunks, now.Add(-time.Hour), nameMatcher)
+}
+
+// faultyStore fails writes while down is set, and blocks them until released
+// if block is set.
+type faultyStore struct {
+	Store
+	down    int32
+	block   chan struct{}
+	started chan struct{}
+}
+
+func (s *faultyStore) Put(ctx context.Context, chunks []Chunk) error {
+	if s.block != nil {
+		s.started <- struct{}{}
+		<-s.block
+	}
+	if atomic.LoadInt32(&s.down) != 0 {
+		return fmt.Errorf("store down")
+	}
+	return s.Store.Put(ctx, chunks)
+}
+
+func TestCoalescingStoreWriteFailures(t *testing.T) {
+	store := &faultyStore{Store: newTestAWSStore(), down: 1}
+	coalescing := NewCoalescingStore(store, CoalescingStoreConfig{MaxChunks: 2, MaxWait: time.Hour})
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	var chunks []Chunk
+	for k := 0; k < 3; k++ {
+		chunks = append(chunks, Chunk{
+			ID:      fmt.Sprintf("chunk%d", k),
+			From:    now.Add(time.Duration(k-3) * 10 * time.Minute),
+			Through: now.Add(time.Duration(k-2)*10*time.Minute - time.Millisecond),
+			Metric:  model.Metric{model.MetricNameLabel: "foo", "bar": "baz"},
+			Data:    []byte(fmt.Sprintf("data%d", k)),
+		})
+	}
+	nameMatcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	test := func(name string) {
+		have, err := coalescing.Get(ctx, now.Add(-time.Hour), now, nameMatcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(chunks, have) {
+			t.Fatalf("%s: wrong chunks - %s", name, diff(chunks, have))
+		}
+	}
+
+	// Failed writes keep the chunks buffered, so the callers mustn't retry.
+	if err := coalescing.Put(ctx, chunks[:2]); err != nil {
+		t.Fatal(err)
+	}
+	if err := coalescing.Put(ctx, chunks[2:]); err != nil {
+		t.Fatal(err)
+	}
+	test("Failed")
+
+	atomic.StoreInt32(&store.down, 0)
+	if err := coalescing.Close(); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := store.Get(ctx, now.Add(-time.Hour), now, nameMatcher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 {
+		t.Fatalf("expected a single blob in the store, got %v", stored)
+	}
+	test("Retried")
+}
+
+func TestCoalescingStoreGetWhileWriting(t *testing.T) {
+	store := &faultyStore{Store: newTestAWSStore(), block: make(chan struct{}), started: make(chan struct{})}
+	coalescing := NewCoalescingStore(store, CoalescingStoreConfig{MaxChunks: 1, MaxWait: time.Hour})
+	var once sync.Once
+	release := func() { once.Do(func() { close(store.block) }) }
+	defer release()
+
+	ctx := user.WithID(context.Background(), "0")
+	now := model.Now()
+	chunks := []Chunk{{
+		ID:      "chunk0",
+		From:    now.Add(-10 * time.Minute),
+		Through: now.Add(-time.Millisecond),
+		Metric:  model.Metric{model.MetricNameLabel: "foo", "bar": "baz"},
+		Data:    []byte("data0"),
+	}}
+	nameMatcher := mustNewLabelMatcher(metric.Equal, model.MetricNameLabel, "foo")
+	test := func(name string) {
+		have, err := coalescing.Get(ctx, now.Add(-time.Hour), now, nameMatcher)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(chunks, have) {
+			t.Fatalf("%s: wrong chunks - %s", name, diff(chunks, have))
+		}
+	}
+
+	done := make(chan error)
+	go func() { done <- coalescing.Put(ctx, chunks) }()
+	<-store.started
+	test("Writing")
+	release()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	test("Written")
+}
+
+func TestDecodeTruncatedBlob(t *testing.T) {
+	var chunks []Chunk
+	for k := 0; k < 3; k++ {
+		chunks = append(chunks, Chunk{
+			ID:      fmt.Sprintf("chunk%d", k),
+			From:    model.Time(k * 10),
+			Through: model.Time(k*10 + 9),
+			Metric:  model.Metric{model.MetricNameLabel: "foo"},
+			Data:    []byte(fmt.Sprintf("data%d", k)),
+		})
+	}
+	blob := encodeBlob(chunks)
+	if blob.From != 0 || blob.Through != 29 {
+		t.Fatalf("expected blob to span [0, 29], got [%v, %v]", blob.From, blob.Through)
+	}
+	have, err := decodeBlob(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(chunks, have) {
+		t.Fatalf("wrong chunks - %s", diff(chunks, have))
+	}
+
+	// Each record takes the same space, so a third of the blob holds one.
+	record := len(blob.Data) / 3
+	for cut := 0; cut < len(blob.Data); cut++ {
+		damaged := blob
+		damaged.Data = blob.Data[:cut]
+		have, err := decodeBlob(damaged)
+		complete := cut / record
+		if (err == nil) != (cut%record == 0) {
+			t.Fatalf("cut at %d: unexpected error %v", cut, err)
+		}
+		if !reflect.DeepEqual(chunks[:complete], have) && !(complete == 0 && have == nil) {
+			t.Fatalf("cut at %d: wrong chunks - %s", cut, diff(chunks[:complete], have))
+		}
+	}
+}
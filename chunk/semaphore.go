@@ -1,9 +1,16 @@
 package chunk
 
+import "math"
+
 // Semaphore allows users to control the level of concurrency of the Put function.
 type Semaphore interface {
 	Acquire()
 	Release()
+
+	// Available returns how many more Acquires would succeed without
+	// blocking, InUse how many are currently held.
+	Available() int
+	InUse() int
 }
 
 type semaphore chan struct{}
@@ -25,11 +32,28 @@ func (s semaphore) Release() {
 	s <- struct{}{}
 }
 
+// Available is the number of tokens left in the channel.
+func (s semaphore) Available() int {
+	return len(s)
+}
+
+// InUse is derived from a single len, so it is consistent under concurrent
+// Acquires and Releases.
+func (s semaphore) InUse() int {
+	return cap(s) - len(s)
+}
+
 type noopSemaphore int
 
 func (noopSemaphore) Acquire() {}
 
 func (noopSemaphore) Release() {}
 
+// Available is unbounded for a noopSemaphore.
+func (noopSemaphore) Available() int { return math.MaxInt32 }
+
+// InUse is always zero for a noopSemaphore, as it does not count.
+func (noopSemaphore) InUse() int { return 0 }
+
 // NoopSemaphore is a no-op semaphore
 const NoopSemaphore = noopSemaphore(0)
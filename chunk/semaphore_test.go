@@ -1,6 +1,9 @@
 package chunk
 
-import "testing"
+import (
+	"sync"
+	"testing"
+)
 
 func TestSemaphore(t *testing.T) {
 	// A very dump test
@@ -8,3 +11,31 @@ func TestSemaphore(t *testing.T) {
 	s.Acquire()
 	s.Release()
 }
+
+func TestSemaphoreCounts(t *testing.T) {
+	s := NewSemaphore(10)
+	var wg sync.WaitGroup
+	for i := 0; i < 7; i++ {
+		wg.Add(1)
+		go func() {
+			s.Acquire()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if s.InUse() != 7 || s.Available() != 3 {
+		t.Fatalf("expected 7 in use and 3 available, got %d and %d", s.InUse(), s.Available())
+	}
+
+	for i := 0; i < 7; i++ {
+		wg.Add(1)
+		go func() {
+			s.Release()
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	if s.InUse() != 0 || s.Available() != 10 {
+		t.Fatalf("expected 0 in use and 10 available, got %d and %d", s.InUse(), s.Available())
+	}
+}
@@ -77,6 +77,9 @@ type cfg struct {
 	flushPeriod          time.Duration
 	maxChunkAge          time.Duration
 	numTokens            int
+	memoryChunksSoft     int
+	memoryChunksHard     int
+	chunkIDScheme        string
 }
 
 func main() {
@@ -96,6 +99,9 @@ func main() {
 	flag.DurationVar(&cfg.flushPeriod, "ingester.flush-period", 1*time.Minute, "Period with which to attempt to flush chunks.")
 	flag.DurationVar(&cfg.maxChunkAge, "ingester.max-chunk-age", 10*time.Minute, "Maximum chunk age before flushing.")
 	flag.IntVar(&cfg.numTokens, "ingester.num-tokens", 128, "Number of tokens for each ingester.")
+	flag.IntVar(&cfg.memoryChunksSoft, "ingester.memory-chunks-soft-limit", 0, "Number of chunks in memory above which the ingester asks for throttling and flushes aggressively. 0 to disable.")
+	flag.IntVar(&cfg.memoryChunksHard, "ingester.memory-chunks-hard-limit", 0, "Number of chunks in memory above which the ingester rejects samples. 0 to disable.")
+	flag.StringVar(&cfg.chunkIDScheme, "ingester.chunk-id-scheme", "v1", "Scheme of the IDs flushed chunks are stored under: v1 (fp:from:through) or v2 (v2:user:fp:from:through, for stores not prefixing keys by user).")
 	flag.Parse()
 
 	chunkStore, err := setupChunkStore(cfg)
@@ -125,9 +131,16 @@ func main() {
 			log.Fatalf("Could not register ingester: %v", err)
 		}
 		defer registration.Unregister()
+		chunkIDFunc, ok := local.ChunkIDSchemes[cfg.chunkIDScheme]
+		if !ok {
+			log.Fatalf("Unknown chunk ID scheme %q", cfg.chunkIDScheme)
+		}
 		cfg := local.IngesterConfig{
-			FlushCheckPeriod: cfg.flushPeriod,
-			MaxChunkAge:      cfg.maxChunkAge,
+			FlushCheckPeriod:      cfg.flushPeriod,
+			MaxChunkAge:           cfg.maxChunkAge,
+			MemoryChunksSoftLimit: cfg.memoryChunksSoft,
+			MemoryChunksHardLimit: cfg.memoryChunksHard,
+			ChunkIDFunc:           chunkIDFunc,
 		}
 		ingester := setupIngester(chunkStore, cfg)
 		defer ingester.Stop()
@@ -62,11 +62,11 @@ func (c *IngesterClient) Append(ctx context.Context, samples []*model.Sample) er
 		ts := &remote.TimeSeries{
 			Labels: make([]*remote.LabelPair, 0, len(s.Metric)),
 		}
-		for k, v := range s.Metric {
+		for _, k := range sortedLabelNames(s.Metric) {
 			ts.Labels = append(ts.Labels,
 				&remote.LabelPair{
 					Name:  string(k),
-					Value: string(v),
+					Value: string(s.Metric[k]),
 				})
 		}
 		ts.Samples = []*remote.Sample{
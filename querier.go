@@ -50,6 +50,10 @@ func (q *ChunkQuerier) Query(ctx context.Context, from, to model.Time, matchers
 	sampleStreams := map[model.Fingerprint]*model.SampleStream{}
 
 	for _, c := range chunks {
+		values, err := local.DecodeChunk(c.Data)
+		if err != nil {
+			return nil, err
+		}
 		fp := c.Metric.Fingerprint()
 		ss, ok := sampleStreams[fp]
 		if !ok {
@@ -58,7 +62,7 @@ func (q *ChunkQuerier) Query(ctx context.Context, from, to model.Time, matchers
 			}
 			sampleStreams[fp] = ss
 		}
-		ss.Values = append(ss.Values, local.DecodeDoubleDeltaChunk(c.Data)...)
+		ss.Values = append(ss.Values, values...)
 	}
 
 	for _, ss := range sampleStreams {
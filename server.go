@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 
 	"github.com/golang/protobuf/proto"
 	"github.com/golang/snappy"
@@ -65,6 +66,17 @@ func parseRequest(w http.ResponseWriter, r *http.Request, req proto.Message) (ct
 	return ctx, false
 }
 
+// sortedLabelNames returns the label names of the metric in sorted order, so
+// that metrics serialize to the same bytes regardless of map iteration order.
+func sortedLabelNames(m model.Metric) model.LabelNames {
+	names := make(model.LabelNames, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Sort(names)
+	return names
+}
+
 func writeResponse(w http.ResponseWriter, resp proto.Message) {
 	data, err := proto.Marshal(resp)
 	if err != nil {
@@ -134,7 +146,7 @@ func AppenderHandler(appender SampleAppender) http.Handler {
 
 		resp, err := grpcHandler.Write(ctx, &req)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), appendErrorStatus(err))
 			return
 		}
 
@@ -156,6 +168,23 @@ func AppenderHandler(appender SampleAppender) http.Handler {
 	})
 }
 
+// appendErrorStatus maps an error from Append to an HTTP status code. Errors
+// which say whether retrying may help become 429 (retry later) or 400 (don't
+// retry), all others 500.
+func appendErrorStatus(err error) int {
+	r, ok := err.(interface {
+		Retryable() bool
+	})
+	switch {
+	case !ok:
+		return http.StatusInternalServerError
+	case r.Retryable():
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusBadRequest
+	}
+}
+
 // QueryHandler returns a http.Handler that accepts protobuf formatted
 // query requests and serves them.
 func QueryHandler(querier Querier) http.Handler {
@@ -204,12 +233,12 @@ func QueryHandler(querier Querier) http.Handler {
 			ts := &generic.TimeSeries{
 				Name: proto.String(string(ss.Metric[model.MetricNameLabel])),
 			}
-			for k, v := range ss.Metric {
+			for _, k := range sortedLabelNames(ss.Metric) {
 				if k != model.MetricNameLabel {
 					ts.Labels = append(ts.Labels,
 						&generic.LabelPair{
 							Name:  proto.String(string(k)),
-							Value: proto.String(string(v)),
+							Value: proto.String(string(ss.Metric[k])),
 						})
 				}
 			}
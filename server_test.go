@@ -0,0 +1,142 @@
+// Copyright 2016 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package frankenstein
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/storage/metric"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/prometheus/storage/remote/generic"
+	"golang.org/x/net/context"
+
+	"github.com/weaveworks/frankenstein/user"
+)
+
+// Maps built in different orders iterate differently, but must serialize the
+// same.
+var labelNames = []model.LabelName{"__name__", "job", "instance", "a", "z", "mode", "cpu"}
+
+func metricsInBothOrders() (model.Metric, model.Metric) {
+	a, b := model.Metric{}, model.Metric{}
+	for i, name := range labelNames {
+		a[name] = model.LabelValue(name)
+		reversed := labelNames[len(labelNames)-1-i]
+		b[reversed] = model.LabelValue(reversed)
+	}
+	return a, b
+}
+
+func TestIngesterClientAppendSortsLabels(t *testing.T) {
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(snappy.NewReader(r.Body))
+		if err != nil {
+			t.Error(err)
+		}
+		bodies = append(bodies, body)
+	}))
+	defer server.Close()
+
+	client, err := NewIngesterClient(server.Listener.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := user.WithID(context.Background(), "1")
+	a, b := metricsInBothOrders()
+	for i := 0; i < 10; i++ {
+		for _, m := range []model.Metric{a, b} {
+			if err := client.Append(ctx, []*model.Sample{{Metric: m, Timestamp: 1, Value: 1}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, body := range bodies[1:] {
+		if !bytes.Equal(body, bodies[0]) {
+			t.Fatalf("expected %x, got %x", bodies[0], body)
+		}
+	}
+	var req remote.WriteRequest
+	if err := proto.Unmarshal(bodies[0], &req); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, l := range req.Timeseries[0].Labels {
+		names = append(names, l.Name)
+	}
+	if !sort.StringsAreSorted(names) || len(names) != len(labelNames) {
+		t.Fatalf("expected all labels in sorted order, got %v", names)
+	}
+}
+
+type staticQuerier model.Matrix
+
+func (q staticQuerier) Query(context.Context, model.Time, model.Time, ...*metric.LabelMatcher) (model.Matrix, error) {
+	return model.Matrix(q), nil
+}
+
+func (q staticQuerier) LabelValuesForLabelName(context.Context, model.LabelName) (model.LabelValues, error) {
+	return nil, nil
+}
+
+func TestQueryHandlerSortsLabels(t *testing.T) {
+	a, b := metricsInBothOrders()
+	query := func(m model.Metric) []byte {
+		handler := QueryHandler(staticQuerier{{Metric: m, Values: []model.SamplePair{{Timestamp: 1, Value: 1}}}})
+		reqBody, err := proto.Marshal(&generic.GenericReadRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/query", bytes.NewReader(reqBody))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(userIDHeaderName, "1")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body)
+		}
+		return w.Body.Bytes()
+	}
+
+	want := query(a)
+	for i := 0; i < 10; i++ {
+		if got := query(b); !bytes.Equal(got, want) {
+			t.Fatalf("expected %x, got %x", want, got)
+		}
+	}
+	var resp generic.GenericReadResponse
+	if err := proto.Unmarshal(want, &resp); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, l := range resp.Timeseries[0].Labels {
+		names = append(names, l.GetName())
+	}
+	if !reflect.DeepEqual(names, []string{"a", "cpu", "instance", "job", "mode", "z"}) {
+		t.Fatalf("expected the labels but the name in sorted order, got %v", names)
+	}
+}